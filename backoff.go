@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// ReconnectConfig is the `reconnect:` config block controlling the backoff
+// between dial/resubscribe attempts and the circuit breaker that kicks in
+// after too many consecutive failures.
+type ReconnectConfig struct {
+	Initial     string  `mapstructure:"initial"`
+	Max         string  `mapstructure:"max"`
+	Multiplier  float64 `mapstructure:"multiplier"`
+	Jitter      float64 `mapstructure:"jitter"`
+	MaxAttempts int     `mapstructure:"max_attempts"`
+}
+
+// backoffDuration returns initial * multiplier^attempt, clamped to max and
+// then jittered by ±jitter (e.g. jitter 0.2 spreads the result ±20%).
+// attempt is 0-based: the first retry after a failure uses attempt 0.
+func backoffDuration(initial, max time.Duration, multiplier, jitter float64, attempt int) time.Duration {
+	d := float64(initial) * math.Pow(multiplier, float64(attempt))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if jitter > 0 {
+		d += d * jitter * (rand.Float64()*2 - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// reconnectBackoff tracks consecutive-failure count and circuit-breaker
+// state for a single worker's reconnect loop. It is shared by both the
+// initial dial and mid-stream reconnect paths in connectAndSubscribe.
+type reconnectBackoff struct {
+	initial     time.Duration
+	max         time.Duration
+	multiplier  float64
+	jitter      float64
+	maxAttempts int
+
+	attempts int
+	open     bool
+}
+
+func newReconnectBackoff(cfg ReconnectConfig) *reconnectBackoff {
+	multiplier := cfg.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2.0
+	}
+	return &reconnectBackoff{
+		initial:     durationOrDefault(cfg.Initial, time.Second),
+		max:         durationOrDefault(cfg.Max, 5*time.Minute),
+		multiplier:  multiplier,
+		jitter:      cfg.Jitter,
+		maxAttempts: cfg.MaxAttempts,
+	}
+}
+
+func durationOrDefault(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// next reports how long to wait before the next attempt and whether the
+// circuit breaker is open. Once maxAttempts consecutive failures have
+// accrued (maxAttempts == 0 means never), the breaker opens and every
+// subsequent call probes at most once per max, without growing attempts
+// further.
+func (b *reconnectBackoff) next() (time.Duration, bool) {
+	if b.open {
+		return b.max, true
+	}
+	d := backoffDuration(b.initial, b.max, b.multiplier, b.jitter, b.attempts)
+	b.attempts++
+	if b.maxAttempts > 0 && b.attempts >= b.maxAttempts {
+		b.open = true
+		return b.max, true
+	}
+	return d, false
+}
+
+// reset clears the failure counter and closes the circuit breaker. Call it
+// once the Subscribe stream has been up for at least resetThreshold().
+func (b *reconnectBackoff) reset() {
+	b.attempts = 0
+	b.open = false
+}
+
+func (b *reconnectBackoff) resetThreshold() time.Duration {
+	return 2 * b.initial
+}
+
+// setCircuitOpen records the breaker state so the health subsystem can
+// mark the target unhealthy while it's open.
+func setCircuitOpen(jctx *JCtx, open bool) {
+	var v int32
+	if open {
+		v = 1
+	}
+	atomic.StoreInt32(&jctx.circuitOpen, v)
+}
+
+func isCircuitOpen(jctx *JCtx) bool {
+	return atomic.LoadInt32(&jctx.circuitOpen) == 1
+}
+
+// waitBackoff sleeps for the backoff's next interval (or returns false
+// immediately if ctx is cancelled first), logging once when the circuit
+// breaker newly opens.
+func waitBackoff(ctx context.Context, jctx *JCtx, bo *reconnectBackoff, idx int) bool {
+	wasOpen := isCircuitOpen(jctx)
+	wait, open := bo.next()
+	if open && !wasOpen {
+		jLog(jctx, fmt.Sprintf("[%d] circuit breaker open after %d consecutive failures; probing every %s until healthy", idx, bo.attempts, bo.max))
+	}
+	setCircuitOpen(jctx, open)
+	return sleepOrDone(ctx, wait)
+}
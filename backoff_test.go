@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	tests := []struct {
+		name       string
+		initial    time.Duration
+		max        time.Duration
+		multiplier float64
+		jitter     float64
+		attempt    int
+		want       time.Duration
+	}{
+		{
+			name:       "attempt 0 is initial",
+			initial:    time.Second,
+			max:        time.Minute,
+			multiplier: 2,
+			attempt:    0,
+			want:       time.Second,
+		},
+		{
+			name:       "grows by multiplier per attempt",
+			initial:    time.Second,
+			max:        time.Minute,
+			multiplier: 2,
+			attempt:    3,
+			want:       8 * time.Second,
+		},
+		{
+			name:       "clamped to max",
+			initial:    time.Second,
+			max:        5 * time.Second,
+			multiplier: 2,
+			attempt:    10,
+			want:       5 * time.Second,
+		},
+		{
+			name:       "no jitter is deterministic",
+			initial:    2 * time.Second,
+			max:        time.Minute,
+			multiplier: 3,
+			jitter:     0,
+			attempt:    1,
+			want:       6 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := backoffDuration(tt.initial, tt.max, tt.multiplier, tt.jitter, tt.attempt)
+			if got != tt.want {
+				t.Errorf("backoffDuration(%v, %v, %v, %v, %d) = %v, want %v", tt.initial, tt.max, tt.multiplier, tt.jitter, tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDurationJitterWithinBounds(t *testing.T) {
+	initial := time.Second
+	max := time.Minute
+	jitter := 0.2
+	for i := 0; i < 100; i++ {
+		d := backoffDuration(initial, max, 2, jitter, 0)
+		lo := float64(initial) * (1 - jitter)
+		hi := float64(initial) * (1 + jitter)
+		if float64(d) < lo || float64(d) > hi {
+			t.Fatalf("backoffDuration jittered result %v out of bounds [%v, %v]", d, time.Duration(lo), time.Duration(hi))
+		}
+	}
+}
+
+func TestReconnectBackoffNext(t *testing.T) {
+	bo := newReconnectBackoff(ReconnectConfig{
+		Initial:     "1s",
+		Max:         "8s",
+		Multiplier:  2,
+		MaxAttempts: 3,
+	})
+
+	d, open := bo.next()
+	if open || d != time.Second {
+		t.Fatalf("attempt 1: got (%v, %v), want (1s, false)", d, open)
+	}
+
+	d, open = bo.next()
+	if open || d != 2*time.Second {
+		t.Fatalf("attempt 2: got (%v, %v), want (2s, false)", d, open)
+	}
+
+	// MaxAttempts is 3: the 3rd consecutive failure trips the breaker.
+	d, open = bo.next()
+	if !open || d != bo.max {
+		t.Fatalf("attempt 3: got (%v, %v), want (%v, true)", d, open, bo.max)
+	}
+
+	// Once open, every subsequent call probes at max without growing
+	// attempts further.
+	d, open = bo.next()
+	if !open || d != bo.max {
+		t.Fatalf("attempt 4 (still open): got (%v, %v), want (%v, true)", d, open, bo.max)
+	}
+
+	bo.reset()
+	if bo.attempts != 0 || bo.open {
+		t.Fatalf("after reset: attempts=%d open=%v, want attempts=0 open=false", bo.attempts, bo.open)
+	}
+	d, open = bo.next()
+	if open || d != time.Second {
+		t.Fatalf("attempt after reset: got (%v, %v), want (1s, false)", d, open)
+	}
+}
+
+func TestReconnectBackoffNeverOpensWhenMaxAttemptsZero(t *testing.T) {
+	bo := newReconnectBackoff(ReconnectConfig{Initial: "1s", Max: "4s", Multiplier: 2})
+	for i := 0; i < 10; i++ {
+		if _, open := bo.next(); open {
+			t.Fatalf("circuit breaker opened after %d attempts despite MaxAttempts=0 (never)", i+1)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+// Config is the per-config-file run time configuration, unmarshaled from
+// JSON by viper in configRead.
+type Config struct {
+	Host     string       `mapstructure:"host"`
+	Port     int          `mapstructure:"port"`
+	Hosts    []HostConfig `mapstructure:"hosts"`
+	User     string       `mapstructure:"user"`
+	Password string       `mapstructure:"password"`
+	CID      string       `mapstructure:"cid"`
+	Meta     bool         `mapstructure:"meta"`
+
+	TLS  TLSConfig  `mapstructure:"tls"`
+	GRPC GRPCConfig `mapstructure:"grpc"`
+
+	Reconnect ReconnectConfig `mapstructure:"reconnect"`
+	Tracing   TracingConfig   `mapstructure:"tracing"`
+
+	Paths []PathConfig `mapstructure:"paths"`
+}
+
+// HostConfig is one entry in Config.Hosts: an additional endpoint for the
+// same subscription target, dialed alongside Host/Port for round_robin
+// load balancing and failover.
+type HostConfig struct {
+	Host string `mapstructure:"host"`
+	Port int    `mapstructure:"port"`
+}
+
+// TLSConfig holds the client certificate material used to dial Host/Port
+// (and every entry in Hosts) over TLS. CA left empty means dial insecure.
+type TLSConfig struct {
+	CA         string `mapstructure:"ca"`
+	ClientCrt  string `mapstructure:"clientcrt"`
+	ClientKey  string `mapstructure:"clientkey"`
+	ServerName string `mapstructure:"servername"`
+}
+
+// GRPCConfig holds gRPC transport tuning knobs.
+type GRPCConfig struct {
+	WS int32 `mapstructure:"ws"`
+}
+
+// PathConfig is one telemetry subscription path.
+type PathConfig struct {
+	Path string `mapstructure:"path"`
+	Freq uint64 `mapstructure:"freq"`
+
+	// ReadyRequired marks this path as one /readyz should consider: if
+	// true, its Freq contributes to maxRequiredPathFreq's staleness
+	// threshold for the readiness check.
+	ReadyRequired bool `mapstructure:"ready-required"`
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	gosundheit "github.com/AppsFlyer/go-sundheit"
+	"github.com/AppsFlyer/go-sundheit/checks"
+	gosundheithttp "github.com/AppsFlyer/go-sundheit/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthCheckInterval is how often each registered check re-runs.
+const healthCheckInterval = 15 * time.Second
+
+// livenessReg backs /healthz. No checks are ever registered against it: it
+// reports healthy for as long as the process is up and serving HTTP, which
+// is all liveness is supposed to mean. A target being unreachable or late
+// on telemetry must not fail it, or Kubernetes would restart the whole
+// jtimon process instead of just pulling it out of service via /readyz.
+var livenessReg = gosundheit.New()
+
+// readinessReg backs /readyz; every worker registers one connectivity
+// check and one telemetry freshness check for its target against it.
+var readinessReg = gosundheit.New()
+
+// registerHealthChecks wires up the readiness (connectivity and telemetry
+// freshness) checks for a single worker's JCtx.
+func registerHealthChecks(jctx *JCtx, idx int) {
+	connCheck := checks.NewCustomCheck(fmt.Sprintf("target-%d-conn", idx), func(ctx context.Context) (interface{}, error) {
+		if isCircuitOpen(jctx) {
+			return "circuit breaker open", fmt.Errorf("reconnect circuit breaker is open")
+		}
+
+		jctx.connMu.RLock()
+		conn := jctx.conn
+		jctx.connMu.RUnlock()
+		if conn == nil {
+			return nil, fmt.Errorf("not yet connected")
+		}
+
+		state := conn.GetState()
+		if state != connectivity.Ready && state != connectivity.Idle {
+			return state.String(), fmt.Errorf("connectivity state is %s", state)
+		}
+
+		// Best-effort standard health check; targets that don't
+		// implement grpc.health.v1.Health (Unimplemented) fall back to
+		// the shallow READY/IDLE ping above. Any other error, or a
+		// non-SERVING status, fails the check.
+		hc := healthpb.NewHealthClient(conn)
+		resp, herr := hc.Check(ctx, &healthpb.HealthCheckRequest{})
+		if herr != nil {
+			if status.Code(herr) == codes.Unimplemented {
+				return state.String(), nil
+			}
+			return nil, fmt.Errorf("health check RPC failed: %v", herr)
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			return resp.Status.String(), fmt.Errorf("health check reports status %s", resp.Status)
+		}
+
+		return state.String(), nil
+	})
+	readinessReg.RegisterCheck(&gosundheit.Config{
+		Check:           connCheck,
+		ExecutionPeriod: healthCheckInterval,
+	})
+
+	readyCheck := checks.NewCustomCheck(fmt.Sprintf("target-%d-freshness", idx), func(ctx context.Context) (interface{}, error) {
+		maxFreq := maxRequiredPathFreq(jctx)
+		if maxFreq == 0 {
+			return "no required-for-ready paths configured", nil
+		}
+		age := time.Since(jctx.stats.lastRecv)
+		if age > 2*maxFreq {
+			return age.String(), fmt.Errorf("no telemetry received in %s (want < %s)", age, 2*maxFreq)
+		}
+		return age.String(), nil
+	})
+	readinessReg.RegisterCheck(&gosundheit.Config{
+		Check:           readyCheck,
+		ExecutionPeriod: healthCheckInterval,
+	})
+}
+
+// maxRequiredPathFreq returns the longest reporting interval among paths
+// the operator marked required-for-ready, or 0 if none are.
+func maxRequiredPathFreq(jctx *JCtx) time.Duration {
+	var max time.Duration
+	for _, p := range jctx.config.Paths {
+		if !p.ReadyRequired {
+			continue
+		}
+		if d := time.Duration(p.Freq) * time.Millisecond; d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// registerHealthHandlers mounts /healthz (liveness, livenessReg) and
+// /readyz (readiness, readinessReg) on mux, each reporting only its own
+// failing checks' detail as JSON.
+func registerHealthHandlers(mux *http.ServeMux) {
+	mux.Handle("/healthz", gosundheithttp.HandleHealthJSON(livenessReg))
+	mux.Handle("/readyz", gosundheithttp.HandleHealthJSON(readinessReg))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	flag "github.com/spf13/pflag"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var tracingEndpoint = flag.String("tracing-endpoint", "", "OTLP gRPC exporter endpoint for distributed tracing")
+
+// defaultTraceSampleRatio is used when a target's tracing: block doesn't
+// set sample-ratio.
+const defaultTraceSampleRatio = 1.0
+
+func init() {
+	grpc_prometheus.EnableClientHandlingTimeHistogram()
+}
+
+// TracingConfig is the `tracing:` config block; it lets a target override
+// the process-wide --tracing-endpoint and sampling ratio.
+type TracingConfig struct {
+	Endpoint    string  `mapstructure:"endpoint"`
+	SampleRatio float64 `mapstructure:"sample-ratio"`
+}
+
+// tracerProviders memoizes one TracerProvider (and its OTLP exporter) per
+// distinct endpoint and sample ratio, since --tracing-endpoint and every
+// target's tracing: block can each name a different collector and ratio.
+// Guarded by tracerProvidersMu
+// rather than sync.Once because the set of endpoints isn't known until
+// every config file has been read.
+var (
+	tracerProvidersMu sync.Mutex
+	tracerProviders   = make(map[string]*sdktrace.TracerProvider)
+)
+
+// tracerProviderFor lazily dials an OTLP exporter and TracerProvider for
+// endpoint, reusing one already built for the same endpoint and sample
+// ratio (e.g. by another target) rather than opening a second exporter
+// connection for it.
+func tracerProviderFor(endpoint string, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+	tracerProvidersMu.Lock()
+	defer tracerProvidersMu.Unlock()
+
+	key := fmt.Sprintf("%s|%g", endpoint, sampleRatio)
+	if tp, ok := tracerProviders[key]; ok {
+		return tp, nil
+	}
+
+	exp, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP exporter for %s: %v", endpoint, err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.TraceIDRatioBased(sampleRatio)),
+	)
+	tracerProviders[key] = tp
+	return tp, nil
+}
+
+// shutdownTracing flushes and closes every TracerProvider built by
+// tracerProviderFor. Call once on process exit.
+func shutdownTracing(ctx context.Context) {
+	tracerProvidersMu.Lock()
+	defer tracerProvidersMu.Unlock()
+	for key, tp := range tracerProviders {
+		if err := tp.Shutdown(ctx); err != nil {
+			fmt.Printf("could not shut down tracer provider for %s: %v\n", key, err)
+		}
+	}
+}
+
+// tracingEndpointFor returns jctx's effective OTLP endpoint: its own
+// tracing.endpoint if set, else the process-wide --tracing-endpoint, else
+// "" (tracing disabled for this target).
+func tracingEndpointFor(jctx *JCtx) string {
+	if jctx.config.Tracing.Endpoint != "" {
+		return jctx.config.Tracing.Endpoint
+	}
+	return *tracingEndpoint
+}
+
+func tracingSampleRatioFor(jctx *JCtx) float64 {
+	if jctx.config.Tracing.SampleRatio > 0 {
+		return jctx.config.Tracing.SampleRatio
+	}
+	return defaultTraceSampleRatio
+}
+
+// clientInterceptorOptions builds the DialOptions for jtimon's client-side
+// interceptor chain: per-RPC Prometheus metrics (surfaced alongside
+// jtimon's own counters under /metrics), a structured-log interceptor
+// keyed by jctx.file/index (replacing the ad-hoc jLog calls that used to
+// sit around Dial/LoginCheck), and, if --grpc-headers is set, metadata
+// capture into InfluxDB. OpenTelemetry spans are wired separately via
+// WithStatsHandler since grpc's otel integration is a stats handler, not
+// an interceptor; the TracerProvider behind it is jctx's effective
+// endpoint (tracingEndpointFor), not always the process-wide default, so
+// two targets pointing at different collectors each get their own
+// exporter and sampler.
+func clientInterceptorOptions(jctx *JCtx) ([]grpc.DialOption, error) {
+	unary := []grpc.UnaryClientInterceptor{
+		grpc_prometheus.UnaryClientInterceptor,
+		loggingUnaryInterceptor(jctx),
+	}
+	stream := []grpc.StreamClientInterceptor{
+		grpc_prometheus.StreamClientInterceptor,
+		loggingStreamInterceptor(jctx),
+	}
+	if *grpcHeaders {
+		unary = append(unary, metadataCaptureUnaryInterceptor(jctx))
+		stream = append(stream, metadataCaptureStreamInterceptor(jctx))
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unary...),
+		grpc.WithChainStreamInterceptor(stream...),
+	}
+	if endpoint := tracingEndpointFor(jctx); endpoint != "" {
+		tp, err := tracerProviderFor(endpoint, tracingSampleRatioFor(jctx))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithTracerProvider(tp))))
+	}
+	return opts, nil
+}
+
+// loggingUnaryInterceptor logs LoginCheck (and any other unary RPC)
+// failures keyed by worker index, in place of the manual jLog calls that
+// used to live next to each call site.
+func loggingUnaryInterceptor(jctx *JCtx) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil {
+			jLog(jctx, fmt.Sprintf("[%d] %s failed in %s: %v", jctx.index, method, time.Since(start), err))
+		}
+		return err
+	}
+}
+
+// loggingStreamInterceptor logs Subscribe (and any other streaming RPC)
+// failures to open, keyed by worker index.
+func loggingStreamInterceptor(jctx *JCtx) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			jLog(jctx, fmt.Sprintf("[%d] %s failed to open in %s: %v", jctx.index, method, time.Since(start), err))
+		}
+		return cs, err
+	}
+}
+
+// metadataCaptureUnaryInterceptor captures a unary RPC's response headers
+// for --grpc-headers, replacing the loop that used to build this pmap
+// directly in configRead.
+func metadataCaptureUnaryInterceptor(jctx *JCtx) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		var header metadata.MD
+		opts = append(opts, grpc.Header(&header))
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		captureGRPCHeaders(jctx, header)
+		return err
+	}
+}
+
+// metadataCaptureStreamInterceptor does the same for the Subscribe stream,
+// where leading metadata is only available once Header() returns.
+func metadataCaptureStreamInterceptor(jctx *JCtx) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return cs, err
+		}
+		return &headerCapturingStream{ClientStream: cs, jctx: jctx}, nil
+	}
+}
+
+// headerCapturingStream captures a stream's leading metadata the first
+// time a message is received.
+type headerCapturingStream struct {
+	grpc.ClientStream
+	jctx     *JCtx
+	captured bool
+}
+
+func (s *headerCapturingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if !s.captured {
+		if header, herr := s.Header(); herr == nil {
+			captureGRPCHeaders(s.jctx, header)
+		}
+		s.captured = true
+	}
+	return err
+}
+
+func captureGRPCHeaders(jctx *JCtx, header metadata.MD) {
+	if len(header) == 0 {
+		return
+	}
+	pmap := make(map[string]interface{})
+	for i := range jctx.config.Paths {
+		pmap["path"] = jctx.config.Paths[i].Path
+		pmap["reporting-rate"] = float64(jctx.config.Paths[i].Freq)
+		for k, v := range header {
+			if len(v) > 0 {
+				pmap[k] = v[0]
+			}
+		}
+		addGRPCHeader(jctx, pmap)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -11,17 +12,17 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	auth_pb "github.com/nileshsimaria/jtimon/authentication"
+	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	flag "github.com/spf13/pflag"
 	viper "github.com/spf13/viper"
-	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 )
 
@@ -64,7 +65,6 @@ type JCtx struct {
 	config    Config
 	file      string
 	index     int
-	wg        *sync.WaitGroup
 	dMap      map[uint32]map[uint32]map[string]dropData
 	influxCtx InfluxCtx
 	stats     statsCtx
@@ -74,11 +74,15 @@ type JCtx struct {
 		subch chan bool
 		logch chan bool
 	}
-}
 
-type workerCtx struct {
-	signalch chan os.Signal
-	err      error
+	// connMu guards conn, which the health subsystem reads concurrently
+	// with connectAndSubscribe redialing it on SIGHUP reload.
+	connMu sync.RWMutex
+	conn   *grpc.ClientConn
+
+	// circuitOpen is 1 once the reconnect circuit breaker has tripped;
+	// accessed atomically by backoff.go and the health subsystem.
+	circuitOpen int32
 }
 
 func configRead(jctx *JCtx, init bool) error {
@@ -113,151 +117,292 @@ func configRead(jctx *JCtx, init bool) error {
 			go apiInit(jctx)
 		}
 
-		if *grpcHeaders {
-			pmap := make(map[string]interface{})
-			for i := range jctx.config.Paths {
-				pmap["path"] = jctx.config.Paths[i].Path
-				pmap["reporting-rate"] = float64(jctx.config.Paths[i].Freq)
-				addGRPCHeader(jctx, pmap)
+	}
+
+	return nil
+}
+
+// dialOptions builds the DialOptions common to every connection attempt for
+// a given JCtx (TLS, stats handler, compression, flow control window).
+func dialOptions(jctx *JCtx, idx int) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+
+	if jctx.config.TLS.CA != "" {
+		certificate, _ := tls.LoadX509KeyPair(jctx.config.TLS.ClientCrt, jctx.config.TLS.ClientKey)
+
+		certPool := x509.NewCertPool()
+		bs, err := ioutil.ReadFile(jctx.config.TLS.CA)
+		if err != nil {
+			return nil, fmt.Errorf("[%d] failed to read ca cert: %v", idx, err)
+		}
+
+		ok := certPool.AppendCertsFromPEM(bs)
+		if !ok {
+			return nil, fmt.Errorf("[%d] failed to append certs", idx)
+		}
+
+		transportCreds := credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			ServerName:   jctx.config.TLS.ServerName,
+			RootCAs:      certPool,
+		})
+		opts = append(opts, grpc.WithTransportCredentials(transportCreds))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	if *stateHandler {
+		opts = append(opts, grpc.WithStatsHandler(&statshandler{jctx: jctx}))
+	}
+
+	if *compression != "" {
+		var dc grpc.Decompressor
+		if *compression == "gzip" {
+			dc = grpc.NewGZIPDecompressor()
+		} else if *compression == "deflate" {
+			dc = newDEFLATEDecompressor()
+		}
+		opts = append(opts, grpc.WithDecompressor(dc))
+	}
+
+	opts = append(opts, grpc.WithInitialWindowSize(jctx.config.GRPC.WS))
+
+	// Spread RPCs (and fail over) across every host configured for this
+	// target via the jtimon:/// resolver (resolver.go). WaitForReady itself
+	// is set per-call on the Subscribe RPC only (see the subscribe call in
+	// connectAndSubscribe),
+	// not as a dial default: applied to every RPC it would also make
+	// LoginCheck block/retry inside grpc's transport instead of failing
+	// fast, so a target that's down from the start would never reach
+	// waitBackoff/the reconnect circuit breaker.
+	opts = append(opts, grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"round_robin":{}}]}`))
+
+	tracingOpts, err := clientInterceptorOptions(jctx)
+	if err != nil {
+		return nil, fmt.Errorf("[%d] %v", idx, err)
+	}
+	opts = append(opts, tracingOpts...)
+
+	return opts, nil
+}
+
+// sleepOrDone waits for d, returning true if it elapsed normally or false if
+// ctx was cancelled first.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// connectAndSubscribe dials every host configured for this target through
+// the jtimon:/// round_robin resolver, logs in once, and re-issues the
+// Subscribe RPC in a loop whenever the stream errors. grpc's own subchannel
+// retry/failover handles transport loss, so jtimon does not tear down and
+// redial on every disconnect: the pooled ClientConn is only evicted and
+// redialed when it is in TransientFailure and no other config file shares
+// it.
+func connectAndSubscribe(ctx context.Context, jctx *JCtx, idx int) error {
+	opts, err := dialOptions(jctx, idx)
+	if err != nil {
+		jLog(jctx, err.Error())
+		return err
+	}
+
+	if len(targetAddresses(jctx)) == 0 {
+		return nil
+	}
+
+	login := func(conn *grpc.ClientConn) error {
+		if jctx.config.User == "" || jctx.config.Password == "" || jctx.config.Meta {
+			return nil
+		}
+		lc := auth_pb.NewLoginClient(conn)
+		dat, err := lc.LoginCheck(ctx, &auth_pb.LoginRequest{UserName: jctx.config.User, Password: jctx.config.Password, ClientId: jctx.config.CID})
+		if err != nil {
+			return fmt.Errorf("[%d] could not login: %v", idx, err)
+		}
+		if !dat.Result {
+			return fmt.Errorf("[%d] LoginCheck failed", idx)
+		}
+		return nil
+	}
+
+	bo := newReconnectBackoff(jctx.config.Reconnect)
+
+	var conn *grpc.ClientConn
+	var key string
+	acquire := func() error {
+		c, k, err := connPool.Acquire(jctx, opts, login)
+		if err != nil {
+			return err
+		}
+		conn, key = c, k
+		jctx.connMu.Lock()
+		jctx.conn = conn
+		jctx.connMu.Unlock()
+		return nil
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := acquire(); err != nil {
+			jLog(jctx, fmt.Sprintf("[%d] Could not acquire connection: %v\n", idx, err))
+			if !waitBackoff(ctx, jctx, bo, idx) {
+				return ctx.Err()
 			}
+			continue
 		}
+		break
 	}
+	defer func() { connPool.Release(key) }()
 
-	return nil
+	var retry bool
+	var needsReacquire bool
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if needsReacquire {
+			if err := acquire(); err != nil {
+				jLog(jctx, fmt.Sprintf("[%d] Could not acquire connection: %v\n", idx, err))
+				if !waitBackoff(ctx, jctx, bo, idx) {
+					return ctx.Err()
+				}
+				continue
+			}
+			needsReacquire = false
+		} else if conn.GetState() == connectivity.TransientFailure {
+			// Only force a redial when we're the sole referrer: other
+			// config files may still be sharing this pooled conn, and
+			// evicting it out from under them would leave their eventual
+			// Release decrementing a same-keyed replacement they never
+			// acquired. When shared, leave it alone and let grpc's own
+			// subchannel retry (WaitForReady) heal it.
+			if connPool.EvictIfSole(key) {
+				jLog(jctx, fmt.Sprintf("[%d] pooled connection unhealthy and sole-owned, evicting and redialing", idx))
+				needsReacquire = true
+			} else {
+				jLog(jctx, fmt.Sprintf("[%d] pooled connection unhealthy but shared with other config files, leaving eviction to grpc's own subchannel retry", idx))
+			}
+			if !waitBackoff(ctx, jctx, bo, idx) {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if retry {
+			jLog(jctx, fmt.Sprintf("[%d] Subscribe stream ended, re-issuing Subscribe RPC", idx))
+		}
+
+		start := time.Now()
+		subscribe(conn, jctx, grpc.WaitForReady(true))
+		if time.Since(start) >= bo.resetThreshold() {
+			bo.reset()
+			setCircuitOpen(jctx, false)
+		}
+		retry = true
+		if !waitBackoff(ctx, jctx, bo, idx) {
+			return ctx.Err()
+		}
+	}
 }
 
-// A worker function is the one who gets job done.
-func worker(file string, idx int, wg *sync.WaitGroup) (chan os.Signal, error) {
-	signalch := make(chan os.Signal)
-	jctx := JCtx{
+// worker runs the connect/subscribe, SIGHUP-reload and stats actors for a
+// single config file under an oklog/run.Group, returning once ctx is
+// cancelled or an actor fails.
+func worker(ctx context.Context, file string, idx int) error {
+	jctx := &JCtx{
 		file:  file,
 		index: idx,
-		wg:    wg,
 		stats: statsCtx{
 			startTime: time.Now(),
 		},
 	}
 
-	err := configRead(&jctx, true)
-	if err != nil {
+	if err := configRead(jctx, true); err != nil {
 		fmt.Println(err)
-		return signalch, err
+		return err
 	}
 
-	go func() {
-		for {
-			select {
-			case sig := <-signalch:
-				switch sig {
-				case os.Interrupt:
-					// Received Interrupt Signal, Stop the program
-					printSummary(&jctx)
-					fmt.Println("Signal handling")
-					wg.Done()
-				case syscall.SIGHUP:
-					jctx.pause.subch <- true
-					jctx.pause.logch <- true
-					configRead(&jctx, false)
-				case syscall.SIGCONT:
-					go func() {
-						var retry bool
-						var opts []grpc.DialOption
-
-						if jctx.config.TLS.CA != "" {
-							certificate, _ := tls.LoadX509KeyPair(jctx.config.TLS.ClientCrt, jctx.config.TLS.ClientKey)
-
-							certPool := x509.NewCertPool()
-							bs, err := ioutil.ReadFile(jctx.config.TLS.CA)
-							if err != nil {
-								jLog(&jctx, fmt.Sprintf("[%d] Failed to read ca cert: %s\n", idx, err))
-								return
-							}
-
-							ok := certPool.AppendCertsFromPEM(bs)
-							if !ok {
-								jLog(&jctx, fmt.Sprintf("[%d] Failed to append certs\n", idx))
-								return
-							}
-
-							transportCreds := credentials.NewTLS(&tls.Config{
-								Certificates: []tls.Certificate{certificate},
-								ServerName:   jctx.config.TLS.ServerName,
-								RootCAs:      certPool,
-							})
-							opts = append(opts, grpc.WithTransportCredentials(transportCreds))
-						} else {
-							opts = append(opts, grpc.WithInsecure())
-						}
-
-						if *stateHandler {
-							opts = append(opts, grpc.WithStatsHandler(&statshandler{jctx: &jctx}))
-						}
-
-						if *compression != "" {
-							var dc grpc.Decompressor
-							if *compression == "gzip" {
-								dc = grpc.NewGZIPDecompressor()
-							} else if *compression == "deflate" {
-								dc = newDEFLATEDecompressor()
-							}
-							compressionOpts := grpc.Decompressor(dc)
-							opts = append(opts, grpc.WithDecompressor(compressionOpts))
-						}
-
-						ws := jctx.config.GRPC.WS
-						opts = append(opts, grpc.WithInitialWindowSize(ws))
-
-						hostname := jctx.config.Host + ":" + strconv.Itoa(jctx.config.Port)
-						if hostname == ":0" {
-							return
-						}
-					connect:
-						if retry {
-							jLog(&jctx, fmt.Sprintf("Reconnecting to %s", hostname))
-						} else {
-							jLog(&jctx, fmt.Sprintf("Connecting to %s", hostname))
-						}
-						conn, err := grpc.Dial(hostname, opts...)
-						if err != nil {
-							jLog(&jctx, fmt.Sprintf("[%d] Could not dial: %v\n", idx, err))
-							time.Sleep(10 * time.Second)
-							retry = true
-							goto connect
-						}
-
-						if jctx.config.User != "" && jctx.config.Password != "" {
-							user := jctx.config.User
-							pass := jctx.config.Password
-							if !jctx.config.Meta {
-								lc := auth_pb.NewLoginClient(conn)
-								dat, err := lc.LoginCheck(context.Background(), &auth_pb.LoginRequest{UserName: user, Password: pass, ClientId: jctx.config.CID})
-								if err != nil {
-									jLog(&jctx, fmt.Sprintf("[%d] Could not login: %v\n", idx, err))
-									return
-								}
-								if !dat.Result {
-									jLog(&jctx, fmt.Sprintf("[%d] LoginCheck failed", idx))
-									return
-								}
-							}
-						}
-
-						subscribe(conn, &jctx)
-						// Close the current connection and retry
-						conn.Close()
-						// If we are here we must try to reconnect again.
-						// Reconnect after 10 seconds.
-						time.Sleep(10 * time.Second)
-						retry = true
-						goto connect
-					}()
+	registerHealthChecks(jctx, idx)
+
+	// reloadCh is fed by the SIGHUP actor below and consumed by the
+	// subscribe actor to trigger a reload; see that actor for details.
+	reloadCh := make(chan struct{}, 1)
+
+	var g run.Group
+	{
+		// Subscribe/reconnect actor. A reload cancels the running
+		// connectAndSubscribe's sub-context, re-reads the config, and
+		// starts a fresh one, so a config change (e.g. a new Host) takes
+		// effect without a process restart.
+		stopCtx, stop := context.WithCancel(ctx)
+		g.Add(func() error {
+			for {
+				subCtx, subCancel := context.WithCancel(stopCtx)
+				errCh := make(chan error, 1)
+				go func() { errCh <- connectAndSubscribe(subCtx, jctx, idx) }()
+
+				select {
+				case err := <-errCh:
+					subCancel()
+					return err
+				case <-reloadCh:
+					subCancel()
+					<-errCh
+					if err := configRead(jctx, false); err != nil {
+						jLog(jctx, fmt.Sprintf("[%d] config reload failed: %v\n", idx, err))
+					}
 				}
 			}
-		}
-	}()
+		}, func(error) {
+			stop()
+		})
+	}
+	{
+		// SIGHUP config-reload listener.
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		done := make(chan struct{})
+		g.Add(func() error {
+			for {
+				select {
+				case <-hupCh:
+					select {
+					case reloadCh <- struct{}{}:
+					default:
+						// a reload is already in flight
+					}
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-done:
+					return nil
+				}
+			}
+		}, func(error) {
+			signal.Stop(hupCh)
+			close(done)
+		})
+	}
+	{
+		// API/stats actor. periodicStats and apiInit are already
+		// started by configRead(jctx, true) above; this actor just
+		// ties their lifetime to ctx so g.Run() blocks until shutdown.
+		g.Add(func() error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, func(error) {})
+	}
 
-	fmt.Println("Returning from worker")
-	return signalch, nil
+	err := g.Run()
+	printSummary(jctx)
+	return err
 }
 
 func testMyCode() {
@@ -296,8 +441,10 @@ func main() {
 	if *prom {
 		go func() {
 			addr := fmt.Sprintf("localhost:%d", promPort)
-			http.Handle("/metrics", promhttp.Handler())
-			fmt.Println(http.ListenAndServe(addr, nil))
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			registerHealthHandlers(mux)
+			fmt.Println(http.ListenAndServe(addr, mux))
 		}()
 
 	}
@@ -324,66 +471,41 @@ func main() {
 		return
 	}
 
-	n := len(*cfgFile)
-	var wg sync.WaitGroup
-	wg.Add(n)
-	wList := make([]*workerCtx, n)
+	defer shutdownTracing(context.Background())
 
-	for idx, file := range *cfgFile {
-		signalch, err := worker(file, idx, &wg)
-		if err != nil {
-			wg.Done()
-		}
-		wList[idx] = &workerCtx{
-			signalch: signalch,
-			err:      err,
-		}
-	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	// Start the Worked go routines which are waiting on the select loop
-	for _, worker := range wList {
-		if worker.err == nil {
-			worker.signalch <- syscall.SIGCONT
-		}
+	// Each worker gets its own independent lifecycle: one config file
+	// hitting max_attempts or a bad TLS cert path must not take down
+	// monitoring for every other config file. A worker still runs its own
+	// three actors (subscribe, SIGHUP-reload, stats) under oklog/run.Group
+	// internally; it's only across workers that there's no shared group.
+	var wg sync.WaitGroup
+	for idx, file := range *cfgFile {
+		idx, file := idx, file
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := worker(ctx, file, idx); err != nil {
+				fmt.Printf("[%d] worker for %s exited: %v\n", idx, file, err)
+			}
+		}()
 	}
 
-	go func() {
-		sigchan := make(chan os.Signal, 10)
-		signal.Notify(sigchan, os.Interrupt, syscall.SIGHUP)
-		for {
-			s := <-sigchan
-			switch s {
-			case syscall.SIGHUP:
-				for _, worker := range wList {
-					if worker.err == nil {
-						worker.signalch <- s
-					}
-				}
-			case os.Interrupt:
-				// Send the interrupt to the worker routines and
-				// return
-				for _, worker := range wList {
-					if worker.err == nil {
-						worker.signalch <- s
-					}
-				}
-				return
+	if *mr != 0 {
+		timer := time.NewTimer(time.Second * time.Duration(*mr))
+		go func() {
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				fmt.Printf("max-run of %ds elapsed\n", *mr)
+				cancel()
+			case <-ctx.Done():
 			}
-		}
-	}()
+		}()
+	}
 
-	go func() {
-		if *mr == 0 {
-			return
-		}
-		tickChan := time.NewTimer(time.Second * time.Duration(*mr)).C
-		<-tickChan
-		for _, worker := range wList {
-			if worker.err == nil {
-				worker.signalch <- os.Interrupt
-			}
-		}
-	}()
 	wg.Wait()
 	fmt.Printf("All done ... exiting!\n")
 }
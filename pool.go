@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	flag "github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+)
+
+var poolDisable = flag.Bool("pool-disable", false, "Disable connection pooling; dial one ClientConn per config file")
+
+var (
+	poolConnsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jtimon_pool_conns",
+		Help: "Number of distinct pooled gRPC connections currently open",
+	})
+	poolSharedSubsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "jtimon_pool_shared_subscriptions",
+		Help: "Number of subscriptions reusing an already-open pooled connection",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(poolConnsGauge, poolSharedSubsGauge)
+}
+
+// pooledConn is one entry in the ConnPool: a shared ClientConn plus the
+// refcount of subscriptions using it and a memoized LoginCheck result.
+type pooledConn struct {
+	conn      *grpc.ClientConn
+	refs      int
+	loginOnce sync.Once
+	loginErr  error
+}
+
+func (pc *pooledConn) login(do func(*grpc.ClientConn) error) error {
+	pc.loginOnce.Do(func() {
+		pc.loginErr = do(pc.conn)
+	})
+	return pc.loginErr
+}
+
+// ConnPool hands out refcounted *grpc.ClientConn references keyed by
+// target host(s) + TLS/credentials fingerprint, so config files that split
+// paths across many files for the same device share one TCP connection,
+// one TLS handshake and one LoginCheck instead of paying for each
+// independently. --pool-disable falls back to one conn per config file by
+// folding the worker index into the key, so nothing is ever shared.
+type ConnPool struct {
+	mu    sync.Mutex
+	conns map[string]*pooledConn
+}
+
+var connPool = &ConnPool{conns: make(map[string]*pooledConn)}
+
+// Acquire returns a shared *grpc.ClientConn for jctx's target, dialing one
+// the first time it's needed for that key and memoizing login on it. On
+// success the returned key must be passed to Release exactly once (and, on
+// transport failure, may also be passed to EvictIfSole first). On a login
+// error Acquire has already dropped the caller's reference and evicted the
+// entry itself.
+func (p *ConnPool) Acquire(jctx *JCtx, opts []grpc.DialOption, login func(*grpc.ClientConn) error) (*grpc.ClientConn, string, error) {
+	addrs := targetAddresses(jctx)
+	key := p.key(jctx, addrs)
+
+	p.mu.Lock()
+	if pc, ok := p.conns[key]; ok {
+		pc.refs++
+		p.mu.Unlock()
+		poolSharedSubsGauge.Inc()
+		if err := pc.login(login); err != nil {
+			p.releaseAndEvict(key)
+			return nil, key, err
+		}
+		return pc.conn, key, nil
+	}
+
+	target := "pool-" + key
+	hostResolver.register(target, addrs)
+	conn, err := grpc.NewClient(jtimonScheme+":///"+target, opts...)
+	if err != nil {
+		p.mu.Unlock()
+		return nil, key, err
+	}
+	pc := &pooledConn{conn: conn, refs: 1}
+	p.conns[key] = pc
+	poolConnsGauge.Inc()
+	p.mu.Unlock()
+
+	if err := pc.login(login); err != nil {
+		p.releaseAndEvict(key)
+		return nil, key, err
+	}
+	return conn, key, nil
+}
+
+// releaseAndEvict drops this caller's reference to key and, regardless of
+// any remaining refcount, force-closes and deletes the pooled entry. Used
+// after a failed LoginCheck: unlike a transient transport failure (which
+// may be recoverable for some referrers and not others), a login failure
+// is a property of the credentials baked into the pool key itself, so it
+// applies to every referrer alike. Evicting unconditionally both rolls
+// back the ref bump above (otherwise every failed retry would leak one
+// more, and the entry could never reach refs<=0) and discards the
+// pooledConn's sync.Once, so the next Acquire redials and actually
+// retries the login instead of replaying a permanently memoized error.
+func (p *ConnPool) releaseAndEvict(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.conns[key]
+	if !ok {
+		return
+	}
+	pc.refs--
+	if pc.refs > 0 {
+		poolSharedSubsGauge.Dec()
+	}
+	pc.conn.Close()
+	delete(p.conns, key)
+	poolConnsGauge.Dec()
+}
+
+// Release drops one reference to the pooled conn for key, closing and
+// evicting it once the last referrer is gone.
+func (p *ConnPool) Release(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.conns[key]
+	if !ok {
+		return
+	}
+	pc.refs--
+	if pc.refs <= 0 {
+		pc.conn.Close()
+		delete(p.conns, key)
+		poolConnsGauge.Dec()
+	} else {
+		poolSharedSubsGauge.Dec()
+	}
+}
+
+// EvictIfSole force-closes the pooled conn for key if this caller is the
+// only remaining referrer (refs <= 1), so its own next Acquire rebuilds it
+// from scratch. It reports whether it evicted. When other config files
+// are still sharing the entry, evicting it out from under them would
+// leave their Release calls decrementing a same-keyed replacement
+// connection they never acquired, so the caller must instead leave the
+// conn alone and let grpc's own subchannel retry, or each sharer's own
+// health check, deal with the failure independently.
+func (p *ConnPool) EvictIfSole(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc, ok := p.conns[key]
+	if !ok || pc.refs > 1 {
+		return false
+	}
+	pc.conn.Close()
+	delete(p.conns, key)
+	poolConnsGauge.Dec()
+	return true
+}
+
+func (p *ConnPool) key(jctx *JCtx, addrs []resolver.Address) string {
+	strAddrs := make([]string, len(addrs))
+	for i, a := range addrs {
+		strAddrs[i] = a.Addr
+	}
+	key := poolKey(strAddrs, credentialFingerprint(jctx))
+	if *poolDisable {
+		key = fmt.Sprintf("%s|only-%d", key, jctx.index)
+	}
+	return key
+}
+
+func poolKey(addrs []string, fingerprint string) string {
+	h := sha256.New()
+	for _, a := range addrs {
+		h.Write([]byte(a))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(fingerprint))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func credentialFingerprint(jctx *JCtx) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s", jctx.config.TLS.CA, jctx.config.TLS.ClientCrt, jctx.config.User, jctx.config.Password, jctx.config.CID)
+}
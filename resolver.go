@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// jtimonScheme is the resolver scheme used to surface every host configured
+// for a single subscription target, so grpc's round_robin balancer can load
+// balance and fail over between them without jtimon tearing down the conn.
+const jtimonScheme = "jtimon"
+
+// targetResolverBuilder implements resolver.Builder for the jtimon scheme.
+// Each target (one per pooled connection) registers its resolver.Addresses before
+// dialing; Build then just replays them to the ClientConn. register() is
+// called from ConnPool.Acquire (under ConnPool.mu) while Build() is called
+// by grpc's own resolver goroutine asynchronously from grpc.NewClient, so
+// addrsByTarget needs its own lock independent of ConnPool's.
+type targetResolverBuilder struct {
+	mu            sync.Mutex
+	addrsByTarget map[string][]resolver.Address
+}
+
+func newTargetResolverBuilder() *targetResolverBuilder {
+	return &targetResolverBuilder{addrsByTarget: make(map[string][]resolver.Address)}
+}
+
+// register associates a target name (the resolver.Target's Endpoint) with
+// the set of addresses jtimon should dial for it. It must be called before
+// grpc.NewClient("jtimon:///"+target, ...) for that target.
+func (b *targetResolverBuilder) register(target string, addrs []resolver.Address) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrsByTarget[target] = addrs
+}
+
+func (b *targetResolverBuilder) Scheme() string {
+	return jtimonScheme
+}
+
+func (b *targetResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	b.mu.Lock()
+	addrs := b.addrsByTarget[target.Endpoint()]
+	b.mu.Unlock()
+	if err := cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		return nil, err
+	}
+	return &targetResolver{}, nil
+}
+
+// targetResolver is static: jtimon's target host list only ever changes on
+// SIGHUP config reload, which re-dials rather than re-resolving in place.
+type targetResolver struct{}
+
+func (r *targetResolver) ResolveNow(resolver.ResolveNowOptions) {}
+func (r *targetResolver) Close()                                {}
+
+// hostResolver is the process-wide builder registered with grpc's global
+// resolver registry; every newly dialed pooled connection registers its
+// target under it.
+var hostResolver = newTargetResolverBuilder()
+
+func init() {
+	resolver.Register(hostResolver)
+}
+
+// targetAddresses turns a config's primary Host/Port plus its optional
+// Hosts list into the resolver.Address set for round_robin dialing.
+func targetAddresses(jctx *JCtx) []resolver.Address {
+	addrs := make([]resolver.Address, 0, 1+len(jctx.config.Hosts))
+	if jctx.config.Host != "" {
+		addrs = append(addrs, resolver.Address{Addr: jctx.config.Host + ":" + strconv.Itoa(jctx.config.Port)})
+	}
+	for _, h := range jctx.config.Hosts {
+		addrs = append(addrs, resolver.Address{Addr: h.Host + ":" + strconv.Itoa(h.Port)})
+	}
+	return addrs
+}